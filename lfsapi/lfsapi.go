@@ -1,7 +1,6 @@
 package lfsapi
 
 import (
-	"crypto/tls"
 	"encoding/json"
 	"net"
 	"net/http"
@@ -36,6 +35,11 @@ type Client struct {
 	hostClients map[string]*http.Client
 	clientMu    sync.Mutex
 
+	// sslRoots holds the reloadable TLS trust material for each host
+	// this client has talked to, keyed the same way as hostClients.
+	sslRoots map[string]*tlsRoot
+	sslMu    sync.Mutex
+
 	// only used for per-host ssl certs
 	gitEnv env
 	osEnv  env
@@ -87,6 +91,22 @@ func (c *Client) Do(req *http.Request) (*http.Response, error) {
 	return res, c.handleResponse(res)
 }
 
+// Close stops the background TLS reload goroutines started for every
+// host this client has talked to. Callers that create short-lived
+// Clients (tests, one-shot commands) should call this once they're done
+// with it; long-running processes that keep a Client for their whole
+// lifetime have no need to.
+func (c *Client) Close() error {
+	c.sslMu.Lock()
+	defer c.sslMu.Unlock()
+
+	for _, root := range c.sslRoots {
+		root.Stop()
+	}
+
+	return nil
+}
+
 func (c *Client) httpClient(host string) *http.Client {
 	c.clientMu.Lock()
 	defer c.clientMu.Unlock()
@@ -137,12 +157,7 @@ func (c *Client) httpClient(host string) *http.Client {
 		MaxIdleConnsPerHost: concurrentTransfers,
 	}
 
-	tr.TLSClientConfig = &tls.Config{}
-	if isCertVerificationDisabledForHost(c, host) {
-		tr.TLSClientConfig.InsecureSkipVerify = true
-	} else {
-		tr.TLSClientConfig.RootCAs = getRootCAsForHost(c, host)
-	}
+	tr.TLSClientConfig = tlsConfigFor(c, host)
 
 	httpClient := &http.Client{
 		Transport: tr,
@@ -0,0 +1,575 @@
+package lfsapi
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/git-lfs/git-lfs/errors"
+	"github.com/rubyist/tracerx"
+	"golang.org/x/crypto/pkcs12"
+)
+
+// defaultTLSReloadInterval is how often, in seconds, the background
+// reloader re-stats watched CA/cert files looking for changes. It can be
+// overridden with lfs.tlsreloadinterval; a value of 0 disables polling
+// entirely and trust material is loaded once, at first use.
+const defaultTLSReloadInterval = 60
+
+// tlsMaterial is the set of TLS trust material currently in effect for a
+// single host. It is replaced wholesale (never mutated in place) so that
+// readers via tlsRoot.Pool() and tlsRoot.Certificate() never observe a
+// half-updated pool.
+type tlsMaterial struct {
+	pool *x509.CertPool
+	cert *tls.Certificate // nil when no client certificate is configured
+}
+
+// tlsRoot tracks the reloadable TLS trust material for one host and,
+// once started, polls the backing files for changes so long-running
+// processes can pick up rotated CAs without restarting.
+type tlsRoot struct {
+	host string
+	c    *Client
+
+	current atomic.Value // *tlsMaterial
+
+	startOnce sync.Once
+	stop      chan struct{}
+
+	mu     sync.Mutex
+	mtimes map[string]time.Time
+}
+
+func newTLSRoot(c *Client, host string) *tlsRoot {
+	r := &tlsRoot{host: host, c: c, stop: make(chan struct{})}
+
+	pool := loadRootCAsForHost(c, host)
+	if pool == nil {
+		// A nil pool would be passed straight through as
+		// x509.VerifyOptions{Roots: nil}, which tells the stdlib
+		// verifier to fall back to the OS trust store instead of
+		// failing - the opposite of what a broken http.sslCAInfo
+		// should do. Fail closed with an empty pool instead; reload()
+		// will replace it once the file is fixed.
+		tracerx.Printf("ssl: could not load CAs for %s, trusting nothing until the next successful reload", host)
+		pool = x509.NewCertPool()
+	}
+
+	cert, err := loadClientCertForHost(c, host)
+	if err != nil {
+		tracerx.Printf("ssl: could not load client certificate for %s: %v", host, err)
+	}
+
+	r.current.Store(&tlsMaterial{pool: pool, cert: cert})
+	return r
+}
+
+func (r *tlsRoot) Pool() *x509.CertPool {
+	return r.current.Load().(*tlsMaterial).pool
+}
+
+// Certificate returns the client certificate currently configured for
+// this host, or nil if none is.
+func (r *tlsRoot) Certificate() *tls.Certificate {
+	return r.current.Load().(*tlsMaterial).cert
+}
+
+// reload re-reads the CA and client certificate files for this host and,
+// if they parsed successfully, swaps them in together. A failure to
+// parse either leaves the previously loaded material in place so a bad
+// edit to a CA bundle or cert/key pair can't take down an otherwise
+// working client mid-operation.
+func (r *tlsRoot) reload() {
+	pool := loadRootCAsForHost(r.c, r.host)
+	if pool == nil {
+		tracerx.Printf("ssl: could not reload CAs for %s, keeping previous trust store", r.host)
+		return
+	}
+
+	cert, err := loadClientCertForHost(r.c, r.host)
+	if err != nil {
+		tracerx.Printf("ssl: could not reload client certificate for %s: %v, keeping previous certificate", r.host, err)
+		return
+	}
+
+	r.current.Store(&tlsMaterial{pool: pool, cert: cert})
+}
+
+// watch starts the background polling goroutine, if one isn't already
+// running and polling is enabled. It is safe to call multiple times.
+func (r *tlsRoot) watch(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	r.startOnce.Do(func() {
+		go func() {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+
+			for {
+				select {
+				case <-ticker.C:
+					if r.filesChanged() {
+						r.reload()
+					}
+				case <-r.stop:
+					return
+				}
+			}
+		}()
+	})
+}
+
+// filesChanged reports whether any of the CA or client cert/key files for
+// this host have a newer mtime than the last time we looked. It has no side effects other
+// than updating the bookkeeping used to answer that question next time.
+func (r *tlsRoot) filesChanged() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.mtimes == nil {
+		r.mtimes = make(map[string]time.Time)
+	}
+
+	watched := append(caFilesForHost(r.c, r.host), clientCertFilesForHost(r.c, r.host)...)
+
+	changed := false
+	for _, path := range watched {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+
+		if prev, ok := r.mtimes[path]; !ok || info.ModTime().After(prev) {
+			r.mtimes[path] = info.ModTime()
+			changed = true
+		}
+	}
+
+	return changed
+}
+
+func (r *tlsRoot) Stop() {
+	r.startOnce.Do(func() {})
+	select {
+	case <-r.stop:
+	default:
+		close(r.stop)
+	}
+}
+
+// tlsReloadInterval returns the configured polling interval, honoring
+// lfs.tlsreloadinterval (seconds), defaulting to defaultTLSReloadInterval.
+func tlsReloadInterval(c *Client) time.Duration {
+	secs := c.gitEnv.Int("lfs.tlsreloadinterval", defaultTLSReloadInterval)
+	if secs <= 0 {
+		return 0
+	}
+	return time.Duration(secs) * time.Second
+}
+
+// getRootCAsForHost returns a *tlsRoot for the given host, creating and
+// starting its background reloader on first use. The pool it exposes is
+// safe to read concurrently with reloads.
+func getRootCAsForHost(c *Client, host string) *tlsRoot {
+	c.sslMu.Lock()
+	defer c.sslMu.Unlock()
+
+	if c.sslRoots == nil {
+		c.sslRoots = make(map[string]*tlsRoot)
+	}
+
+	root, ok := c.sslRoots[host]
+	if !ok {
+		root = newTLSRoot(c, host)
+		c.sslRoots[host] = root
+	}
+
+	root.watch(tlsReloadInterval(c))
+
+	return root
+}
+
+// loadRootCAsForHost builds a fresh *x509.CertPool from the system pool
+// plus any CA material configured for host; configured CAs are added to
+// the system roots, not used in place of them. It returns nil (rather than an empty pool) on parse
+// failure so callers can tell "nothing configured" apart from "broken".
+func loadRootCAsForHost(c *Client, host string) *x509.CertPool {
+	pool, _ := x509.SystemCertPool()
+	if pool == nil {
+		pool = x509.NewCertPool()
+	}
+
+	paths := caFilesForHost(c, host)
+	if len(paths) == 0 {
+		return pool
+	}
+
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			tracerx.Printf("ssl: could not read %s: %v", path, err)
+			return nil
+		}
+
+		if !pool.AppendCertsFromPEM(data) {
+			tracerx.Printf("ssl: no certificates found in %s", path)
+			return nil
+		}
+	}
+
+	return pool
+}
+
+// caFilesForHost returns the CA bundle/dir paths configured for host,
+// preferring the per-host http.<host>.sslCAInfo/sslCAPath over the
+// global http.sslCAInfo/sslCAPath.
+func caFilesForHost(c *Client, host string) []string {
+	var paths []string
+
+	if v, ok := hostSSLConfig(c, host, "sslcainfo"); ok {
+		paths = append(paths, v)
+	}
+
+	if dir, ok := hostSSLConfig(c, host, "sslcapath"); ok {
+		entries, err := ioutil.ReadDir(dir)
+		if err == nil {
+			for _, e := range entries {
+				if !e.IsDir() {
+					paths = append(paths, fmt.Sprintf("%s/%s", dir, e.Name()))
+				}
+			}
+		}
+	}
+
+	return paths
+}
+
+// hostSSLConfig looks up an http.<host>.<key> value, falling back to the
+// unscoped http.<key>.
+//
+// This is deliberately a flat host lookup, not EndpointFinder's endpoint
+// matcher: EndpointFinder resolves *LFS API* endpoints (which operation,
+// which remote), it has no notion of arbitrary http.* keys, and git's own
+// per-URL http.* resolution (scheme/userinfo/longest-path-prefix) isn't
+// something EndpointFinder does either. Richer forms like
+// http.https://host/path.sslCert are intentionally not supported here;
+// revisit if a host needs different client certs for different paths.
+func hostSSLConfig(c *Client, host, key string) (string, bool) {
+	if v, ok := c.gitEnv.Get(fmt.Sprintf("http.%s.%s", host, key)); ok && len(v) > 0 {
+		return v, true
+	}
+
+	return c.gitEnv.Get(fmt.Sprintf("http.%s", key))
+}
+
+// clientCertFilesForHost returns the cert/key files configured for host,
+// so the reloader can watch them for rotation the same way it watches
+// CA files.
+func clientCertFilesForHost(c *Client, host string) []string {
+	certPath, ok := hostSSLConfig(c, host, "sslcert")
+	if !ok {
+		return nil
+	}
+
+	paths := []string{certPath}
+	if keyPath, ok := hostSSLConfig(c, host, "sslkey"); ok && keyPath != certPath {
+		paths = append(paths, keyPath)
+	}
+
+	return paths
+}
+
+// hostSSLConfigBool is hostSSLConfig for the handful of http.* settings
+// that are booleans.
+func hostSSLConfigBool(c *Client, host, key string) bool {
+	v, ok := hostSSLConfig(c, host, key)
+	if !ok {
+		return false
+	}
+
+	return parseSSLConfigBool(v)
+}
+
+// parseSSLConfigBool parses a raw http.*ssl* config value the same way
+// hostSSLConfigBool does, for callers that need the boolean semantics but
+// already have the raw value (or need to know whether it was set at all).
+func parseSSLConfigBool(v string) bool {
+	switch strings.ToLower(v) {
+	case "true", "1", "yes", "on":
+		return true
+	default:
+		return false
+	}
+}
+
+// sslCertType reports the configured format of the client certificate,
+// via lfs.sslCertType. PEM is the default; P12 selects a PKCS#12 bundle.
+func sslCertType(c *Client) string {
+	v, _ := c.gitEnv.Get("lfs.sslcerttype")
+	if strings.ToUpper(v) == "P12" {
+		return "P12"
+	}
+	return "PEM"
+}
+
+// loadClientCertForHost resolves and loads the client certificate
+// configured for host via http.sslCert/http.<host>.sslCert (and the
+// matching sslKey), returning (nil, nil) when no client certificate is
+// configured for this host at all.
+func loadClientCertForHost(c *Client, host string) (*tls.Certificate, error) {
+	certPath, ok := hostSSLConfig(c, host, "sslcert")
+	if !ok {
+		return nil, nil
+	}
+
+	var password string
+	if hostSSLConfigBool(c, host, "sslcertpasswordprotected") {
+		pw, err := sslKeyPassword(c, host)
+		if err != nil {
+			return nil, err
+		}
+		password = pw
+	}
+
+	if sslCertType(c) == "P12" {
+		return loadP12ClientCert(certPath, password)
+	}
+
+	keyPath, ok := hostSSLConfig(c, host, "sslkey")
+	if !ok {
+		keyPath = certPath
+	}
+
+	return loadPEMClientCert(certPath, keyPath, password)
+}
+
+// sslKeyPassword resolves the passphrase for a protected client key,
+// preferring GIT_SSL_KEY_PASSWORD and falling back to the configured
+// CredentialHelper, the same way other LFS credential prompts work.
+func sslKeyPassword(c *Client, host string) (string, error) {
+	if pw, ok := c.osEnv.Get("GIT_SSL_KEY_PASSWORD"); ok && len(pw) > 0 {
+		return pw, nil
+	}
+
+	if c.Credentials == nil {
+		return "", errors.New("ssl: client certificate key is password protected and GIT_SSL_KEY_PASSWORD is unset")
+	}
+
+	creds, err := c.Credentials.Fill(Creds{
+		"protocol": "cert",
+		"host":     host,
+		"path":     "ssl-key-password",
+	})
+	if err != nil {
+		return "", errors.Wrap(err, "ssl")
+	}
+
+	return creds["password"], nil
+}
+
+// findPEMPrivateKeyBlock walks the PEM blocks in data looking for the one
+// holding the private key, identified by its Type containing "PRIVATE
+// KEY" (matching "RSA PRIVATE KEY", "EC PRIVATE KEY", "PRIVATE KEY", and
+// their "ENCRYPTED " variants). This lets callers pass a combined
+// cert+key file without assuming the key is the first block in it.
+func findPEMPrivateKeyBlock(data []byte) (*pem.Block, error) {
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil, errors.New("no private key PEM block found")
+		}
+
+		if strings.Contains(block.Type, "PRIVATE KEY") {
+			return block, nil
+		}
+	}
+}
+
+func loadPEMClientCert(certPath, keyPath, password string) (*tls.Certificate, error) {
+	certPEM, err := ioutil.ReadFile(certPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "ssl")
+	}
+
+	keyPEM, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "ssl")
+	}
+
+	if len(password) > 0 {
+		// keyPath may be a combined cert+key PEM (when sslKey isn't
+		// set separately), so scan past any leading CERTIFICATE
+		// blocks to find the actual key block rather than assuming
+		// it's the first one in the file.
+		block, err := findPEMPrivateKeyBlock(keyPEM)
+		if err != nil {
+			return nil, errors.Wrapf(err, "ssl: %s", keyPath)
+		}
+
+		der, err := x509.DecryptPEMBlock(block, []byte(password))
+		if err != nil {
+			return nil, errors.Wrap(err, "ssl: could not decrypt client key")
+		}
+
+		keyPEM = pem.EncodeToMemory(&pem.Block{Type: block.Type, Bytes: der})
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, errors.Wrap(err, "ssl")
+	}
+
+	return &cert, nil
+}
+
+func loadP12ClientCert(path, password string) (*tls.Certificate, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "ssl")
+	}
+
+	key, leaf, err := pkcs12.Decode(data, password)
+	if err != nil {
+		return nil, errors.Wrap(err, "ssl: could not decode PKCS#12 bundle")
+	}
+
+	return &tls.Certificate{
+		Certificate: [][]byte{leaf.Raw},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
+
+func isCertVerificationDisabledForHost(c *Client, host string) bool {
+	if c.SkipSSLVerify {
+		return true
+	}
+
+	v, ok := hostSSLConfig(c, host, "sslverify")
+	if !ok {
+		return false
+	}
+
+	return !parseSSLConfigBool(v)
+}
+
+// stripPort trims a trailing ":port" off a req.Host-style value so it can
+// be used as a certificate DNSName. req.Host carries the port whenever the
+// remote URL has a non-default one (e.g. an enterprise LFS server on
+// :8443), and x509.Certificate.Verify matches DNSName literally, so
+// passing the port through would fail verification against an otherwise
+// valid certificate.
+func stripPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
+
+// verifyPeerCertificate builds a tls.Config.VerifyPeerCertificate closure
+// that verifies against whatever pool root currently holds, rather than
+// the pool snapshotted when the *tls.Config was built. This is what lets
+// an in-flight *http.Client pick up a rotated CA bundle: the transport
+// and its tls.Config are long-lived, but every handshake re-reads the
+// trust store through this closure.
+func verifyPeerCertificate(root *tlsRoot, host string) func([][]byte, [][]*x509.Certificate) error {
+	dnsName := stripPort(host)
+
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		certs := make([]*x509.Certificate, 0, len(rawCerts))
+		for _, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return errors.Wrap(err, "ssl")
+			}
+			certs = append(certs, cert)
+		}
+
+		if len(certs) == 0 {
+			return errors.New("ssl: no certificates presented by server")
+		}
+
+		opts := x509.VerifyOptions{
+			Roots:         root.Pool(),
+			DNSName:       dnsName,
+			Intermediates: x509.NewCertPool(),
+		}
+
+		for _, cert := range certs[1:] {
+			opts.Intermediates.AddCert(cert)
+		}
+
+		_, err := certs[0].Verify(opts)
+		return err
+	}
+}
+
+// ReloadTLS forces an immediate reload of the CA and client certificate
+// material for every host this client has already talked to. It is meant
+// for programmatic triggers (a SIGHUP handler, a test) that shouldn't
+// have to wait for the background poller's next tick.
+func (c *Client) ReloadTLS() error {
+	c.sslMu.Lock()
+	roots := make([]*tlsRoot, 0, len(c.sslRoots))
+	for _, r := range c.sslRoots {
+		roots = append(roots, r)
+	}
+	c.sslMu.Unlock()
+
+	for _, r := range roots {
+		r.reload()
+	}
+
+	return nil
+}
+
+// tlsConfigFor builds the *tls.Config for host, wiring up dynamic root
+// verification and client certificates so rotated CAs and renewed certs
+// take effect without rebuilding the *http.Transport that embeds it.
+func tlsConfigFor(c *Client, host string) *tls.Config {
+	cfg := &tls.Config{}
+
+	root := getRootCAsForHost(c, host)
+	cfg.GetClientCertificate = clientCertificateFor(root)
+
+	if isCertVerificationDisabledForHost(c, host) {
+		cfg.InsecureSkipVerify = true
+		return cfg
+	}
+
+	// InsecureSkipVerify only disables the stdlib's own chain building;
+	// VerifyPeerCertificate below still enforces verification, against
+	// whichever pool root currently holds. This is the standard pattern
+	// for trust stores that need to change after the tls.Config is built.
+	cfg.InsecureSkipVerify = true
+	cfg.VerifyPeerCertificate = verifyPeerCertificate(root, host)
+
+	return cfg
+}
+
+// clientCertificateFor builds a tls.Config.GetClientCertificate closure
+// that returns whichever client certificate root currently holds, so a
+// renewed cert takes effect on the next handshake without rebuilding the
+// *http.Transport. Returning an empty tls.Certificate (rather than an
+// error) when none is configured tells the stdlib to proceed without
+// sending one, which is what every host that isn't doing mTLS wants.
+func clientCertificateFor(root *tlsRoot) func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		if cert := root.Certificate(); cert != nil {
+			return cert, nil
+		}
+		return &tls.Certificate{}, nil
+	}
+}
@@ -0,0 +1,123 @@
+package lfsapi
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestClientCertificateRequiredByServer exercises the mTLS path end to
+// end, through the real c.httpClient(host) the rest of the package uses
+// to make requests: an httptest server configured with
+// tls.RequireAndVerifyClientCert should accept a request once
+// http.sslCert/http.sslKey point at a certificate it trusts, and reject
+// one made by a client with no client certificate configured at all.
+func TestClientCertificateRequiredByServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lfsapi-mtls-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	clientCert, clientKeyPEM, clientCertPEM := generateSelfSignedCert(t)
+
+	certPath := filepath.Join(dir, "client.crt")
+	keyPath := filepath.Join(dir, "client.key")
+	assert.Nil(t, ioutil.WriteFile(certPath, clientCertPEM, 0644))
+	assert.Nil(t, ioutil.WriteFile(keyPath, clientKeyPEM, 0600))
+
+	pool := x509.NewCertPool()
+	pool.AddCert(clientCert.Leaf)
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	srv.TLS = &tls.Config{
+		ClientCAs:  pool,
+		ClientAuth: tls.RequireAndVerifyClientCert,
+	}
+	srv.StartTLS()
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	assert.Nil(t, err)
+
+	caPath := writeCAFile(t, dir, srv.Certificate())
+
+	withCert := make(testEnv)
+	withCert["http.sslcainfo"] = caPath
+	withCert["http.sslcert"] = certPath
+	withCert["http.sslkey"] = keyPath
+
+	authedClient, err := NewClient(make(testEnv), withCert)
+	assert.Nil(t, err)
+
+	res, err := authedClient.httpClient(u.Host).Get(srv.URL)
+	if assert.Nil(t, err) {
+		res.Body.Close()
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+	}
+
+	withoutCert := make(testEnv)
+	withoutCert["http.sslcainfo"] = caPath
+
+	anonClient, err := NewClient(make(testEnv), withoutCert)
+	assert.Nil(t, err)
+
+	_, err = anonClient.httpClient(u.Host).Get(srv.URL)
+	assert.NotNil(t, err, "request without a client certificate should be rejected by the server")
+}
+
+func writeCAFile(t *testing.T, dir string, cert *x509.Certificate) string {
+	path := filepath.Join(dir, "ca.pem")
+	assert.Nil(t, writePEMCert(path, cert))
+	return path
+}
+
+// generateSelfSignedCert returns a self-signed certificate suitable for
+// use as both a TLS client certificate and its own trust anchor, along
+// with its PEM-encoded key and certificate.
+func generateSelfSignedCert(t *testing.T) (*tls.Certificate, []byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "lfsapi-test-client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(10, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	assert.Nil(t, err)
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.Nil(t, err)
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	assert.Nil(t, err)
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	assert.Nil(t, err)
+	cert.Leaf = leaf
+
+	return &cert, keyPEM, certPEM
+}
@@ -0,0 +1,100 @@
+package lfsapi
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testP12Bundle is a PKCS#12 bundle containing a self-signed EC
+// certificate (CN=lfsapi-test-client) and its key, protected by the
+// password "testpass", exported with the legacy RC2/3DES algorithms
+// golang.org/x/crypto/pkcs12 understands.
+const testP12Bundle = `MIIDkgIBAzCCA1gGCSqGSIb3DQEHAaCCA0kEggNFMIIDQTCCAjcGCSqGSIb3DQEHBqCCAigwggIkAgEAMIICHQYJKoZIhvcNAQcBMBwGCiqGSIb3DQEMAQYwDgQIVgHXHqWj6PECAggAgIIB8FRjqPqrdHgtgVKKrQYi90/SdVug/T0ij7QOeZH7l2Uq+bRDLLVFoOrBiU8e0FPrkraYjHwK/t/sL0WlMRZjGFcA7d0X2yWcluZ7/vtwOD9TAJpVxEWubfGA8Yzmp6vdVpG9KoT9IUsifpy7OD3PK0cu3G5ayC4qULIQMZQIs5DDNXaUBXsB9uFqjWVmPfc2fkoiOq+qTgDoYsmPJWuQd5yLGTMsBCul/Kdyk8WBYepgw28FR18YfQAfkjmESVyGe5Oqgx7iQqSEVhQSHsol7mn7jRbZzJ+7ghs7jN6T7zTCMd+pP9ypUez26hHyWL4uGKCVqMZAyYXa0ffL2igIyL6TXnfZWNhYijHNVQc7661xjx9VMheW31lKF73fR4GDdukxYCoUgr30BeWNfSzhzPY3nWQvku29Hn2iBpXBXltKm49Z8IveJBZ4dvFnCTSnETRpuAyMSo53qQT7WvQRdfjOoljr67boN396KnE60k1ezgGJd5t967JgL4Il+k5oqbDgjI2w6aXX5C71skZ49kM1wrjZLqZ+sC22Bjxf79BR0phadMYvclHv1XC9xSwUjY3dRNnlACXbzbvXgHAilizTkJlG/aqNJONeRDX6kZABwxN70LsOAAdTxxCRcNBw7ysWVD8WKBJOxQjfya1RDJ4wggECBgkqhkiG9w0BBwGggfQEgfEwge4wgesGCyqGSIb3DQEMCgECoIG0MIGxMBwGCiqGSIb3DQEMAQMwDgQIk+B2X/kUpnICAggABIGQRWdMxaqgC295x0Jg7mMdDi37AKBJ1krbHmWiYItFFSjNqj60glNwOGet1MQTDTVrhoQ2eifl3RWOst3CilltkwooP+vEcwphjSrB7uoK8efqJRHhCdYuEDu4U2ah5hEqRJEq9cVkv+WJKOEzPzBq4+AQZmBnY/oh55Wgsd2p8p8ER/woHLiL/9GGls8FGI8TMSUwIwYJKoZIhvcNAQkVMRYEFC1BgpDkYfNdBMx4WaM5jiZ7vSqsMDEwITAJBgUrDgMCGgUABBQnSEZZgIgmt3g8bzPOEmlvhOOnuAQI2mBRZEgzXJ8CAggA`
+
+func writeTestP12(t *testing.T, dir string) string {
+	data, err := base64.StdEncoding.DecodeString(testP12Bundle)
+	assert.Nil(t, err)
+
+	path := filepath.Join(dir, "bundle.p12")
+	assert.Nil(t, ioutil.WriteFile(path, data, 0600))
+	return path
+}
+
+func TestLoadClientCertFromPKCS12Bundle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lfsapi-p12-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	p12Path := writeTestP12(t, dir)
+
+	osEnv := make(testEnv)
+	osEnv["GIT_SSL_KEY_PASSWORD"] = "testpass"
+
+	gitEnv := make(testEnv)
+	gitEnv["lfs.sslcerttype"] = "P12"
+	gitEnv["http.sslcert"] = p12Path
+	gitEnv["http.sslcertpasswordprotected"] = "true"
+
+	c, err := NewClient(osEnv, gitEnv)
+	assert.Nil(t, err)
+
+	cert, err := loadClientCertForHost(c, "example.com")
+	assert.Nil(t, err)
+	if assert.NotNil(t, cert) {
+		assert.Equal(t, "lfsapi-test-client", cert.Leaf.Subject.CommonName)
+	}
+}
+
+// stubCredentialHelper is a minimal CredentialHelper that records whether
+// it was asked to fill credentials, for tests that need to assert a
+// password prompt did or didn't happen.
+type stubCredentialHelper struct {
+	called bool
+	creds  Creds
+	err    error
+}
+
+func (s *stubCredentialHelper) Fill(in Creds) (Creds, error) {
+	s.called = true
+	if s.err != nil {
+		return nil, s.err
+	}
+	return s.creds, nil
+}
+
+func (s *stubCredentialHelper) Reject(Creds) error  { return nil }
+func (s *stubCredentialHelper) Approve(Creds) error { return nil }
+
+func TestSSLKeyPasswordPromptsCredentialHelperWhenEnvUnset(t *testing.T) {
+	c, err := NewClient(make(testEnv), make(testEnv))
+	assert.Nil(t, err)
+
+	helper := &stubCredentialHelper{creds: Creds{"password": "hunter2"}}
+	c.Credentials = helper
+
+	pw, err := sslKeyPassword(c, "example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, "hunter2", pw)
+	assert.True(t, helper.called)
+}
+
+func TestSSLKeyPasswordPrefersEnvVarOverCredentialHelper(t *testing.T) {
+	osEnv := make(testEnv)
+	osEnv["GIT_SSL_KEY_PASSWORD"] = "fromenv"
+
+	c, err := NewClient(osEnv, make(testEnv))
+	assert.Nil(t, err)
+
+	helper := &stubCredentialHelper{creds: Creds{"password": "hunter2"}}
+	c.Credentials = helper
+
+	pw, err := sslKeyPassword(c, "example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, "fromenv", pw)
+	assert.False(t, helper.called, "should not prompt when GIT_SSL_KEY_PASSWORD is set")
+}
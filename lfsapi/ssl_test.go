@@ -0,0 +1,164 @@
+package lfsapi
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetRootCAsForHostFallsBackToSystemPool(t *testing.T) {
+	c, err := NewClient(nil, make(testEnv))
+	assert.Nil(t, err)
+
+	root := getRootCAsForHost(c, "git-lfs.example.com")
+	assert.NotNil(t, root.Pool())
+
+	if sys, err := x509.SystemCertPool(); err == nil {
+		assert.Equal(t, sys.Subjects(), root.Pool().Subjects())
+	}
+}
+
+// TestTLSRootReloadsRotatedCA dials two live httptest servers through the
+// real c.httpClient(host) path, the same one every LFS request uses, to
+// exercise the actual tls.Config.VerifyPeerCertificate wiring rather than
+// the CertPool in isolation. It holds one server's response in flight
+// while the CA file is rotated and ReloadTLS() is called, then asserts
+// both that the in-flight response still completes cleanly (a live
+// connection's already-negotiated handshake isn't touched by a root
+// swap) and that a fresh handshake against a second, previously-untrusted
+// server now succeeds once the rotated file trusts it too.
+func TestTLSRootReloadsRotatedCA(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lfsapi-ssl-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	// httptest.NewTLSServer signs every server with the same hardcoded
+	// example certificate unless told otherwise, which would make the
+	// two servers indistinguishable to the verifier below. Give each its
+	// own self-signed cert so trusting one says nothing about the other.
+	release := make(chan struct{})
+	srv1 := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+		w.(http.Flusher).Flush()
+		<-release
+		w.Write([]byte("world"))
+	}))
+	srv1.TLS = &tls.Config{Certificates: []tls.Certificate{*generateSelfSignedServerCert(t)}}
+	srv1.StartTLS()
+	defer srv1.Close()
+
+	srv2 := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	srv2.TLS = &tls.Config{Certificates: []tls.Certificate{*generateSelfSignedServerCert(t)}}
+	srv2.StartTLS()
+	defer srv2.Close()
+
+	u1, err := url.Parse(srv1.URL)
+	assert.Nil(t, err)
+	u2, err := url.Parse(srv2.URL)
+	assert.Nil(t, err)
+
+	caPath := filepath.Join(dir, "ca.pem")
+	assert.Nil(t, writePEMCerts(caPath, srv1.Certificate()))
+
+	gitEnv := make(testEnv)
+	gitEnv["http.sslcainfo"] = caPath
+
+	c, err := NewClient(make(testEnv), gitEnv)
+	assert.Nil(t, err)
+
+	res1, err := c.httpClient(u1.Host).Get(srv1.URL)
+	assert.Nil(t, err)
+	buf := make([]byte, len("hello"))
+	_, err = io.ReadFull(res1.Body, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(buf))
+
+	// srv2's cert isn't trusted yet, so this both proves the negative
+	// and (by calling c.httpClient) creates srv2's tlsRoot up front, so
+	// the reload below exercises an *existing* root picking up newly
+	// trusted material rather than a fresh one loading it from scratch.
+	_, err = c.httpClient(u2.Host).Get(srv2.URL)
+	assert.NotNil(t, err)
+
+	assert.Nil(t, writePEMCerts(caPath, srv1.Certificate(), srv2.Certificate()))
+	assert.Nil(t, c.ReloadTLS())
+
+	close(release)
+	rest, err := ioutil.ReadAll(res1.Body)
+	assert.Nil(t, err)
+	assert.Equal(t, "world", string(rest))
+	res1.Body.Close()
+
+	res2, err := c.httpClient(u2.Host).Get(srv2.URL)
+	if assert.Nil(t, err) {
+		res2.Body.Close()
+		assert.Equal(t, http.StatusOK, res2.StatusCode)
+	}
+}
+
+// generateSelfSignedServerCert returns a self-signed certificate valid for
+// the 127.0.0.1 httptest listens on, distinct on every call so tests can
+// tell two servers' trust material apart.
+func generateSelfSignedServerCert(t *testing.T) *tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(10, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	assert.Nil(t, err)
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.Nil(t, err)
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	assert.Nil(t, err)
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	assert.Nil(t, err)
+	cert.Leaf = leaf
+
+	return &cert
+}
+
+func writePEMCerts(path string, certs ...*x509.Certificate) error {
+	var data []byte
+	for _, cert := range certs {
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+func writePEMCert(path string, cert *x509.Certificate) error {
+	return writePEMCerts(path, cert)
+}